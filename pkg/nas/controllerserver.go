@@ -0,0 +1,280 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nas
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AliyunContainerService/csi-plugin/pkg/utils"
+	log "github.com/Sirupsen/logrus"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+// controllerServer turns the NAS driver from static-PV-only into a dynamic
+// provisioner: CreateVolume allocates a sub-directory per PVC under a
+// configured parent export, DeleteVolume removes (or archives) it.
+type controllerServer struct {
+	*csicommon.DefaultControllerServer
+	mounter mount.Interface
+}
+
+// NewControllerServer creates a controllerServer.
+func NewControllerServer(d *csicommon.CSIDriver) csi.ControllerServer {
+	return &controllerServer{
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		mounter:                 mount.New(""),
+	}
+}
+
+// volumeIdFields is everything DeleteVolume needs to find and remove a
+// sub-directory again, since DeleteVolumeRequest carries no StorageClass
+// parameters or VolumeContext, only the volumeId minted by CreateVolume. It's
+// packed as base64-encoded JSON rather than a delimiter-joined string because
+// opt.Options is a freeform StorageClass parameter that could itself contain
+// any delimiter we picked.
+type volumeIdFields struct {
+	Server          string `json:"server"`
+	Path            string `json:"path"`
+	SubDir          string `json:"subDir"`
+	Vers            string `json:"vers"`
+	Options         string `json:"options"`
+	ArchiveOnDelete bool   `json:"archiveOnDelete"`
+}
+
+func packVolumeId(opt *NasOptions, subDir string, archiveOnDelete bool) (string, error) {
+	data, err := json.Marshal(volumeIdFields{
+		Server:          opt.Server,
+		Path:            opt.Path,
+		SubDir:          subDir,
+		Vers:            opt.Vers,
+		Options:         opt.Options,
+		ArchiveOnDelete: archiveOnDelete,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func unpackVolumeId(volumeId string) (opt *NasOptions, subDir string, archiveOnDelete bool, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(volumeId)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("malformed nas volumeId: %s", volumeId)
+	}
+	var fields volumeIdFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, "", false, fmt.Errorf("malformed nas volumeId: %s", volumeId)
+	}
+	opt = &NasOptions{Server: fields.Server, Path: fields.Path, Vers: fields.Vers, Options: fields.Options}
+	return opt, fields.SubDir, fields.ArchiveOnDelete, nil
+}
+
+// validateSubDir rejects anything that isn't a single, literal path element,
+// so a crafted volume name/volumeId can't make filepath.Join(tmpPath, subDir)
+// escape the mounted export.
+func validateSubDir(subDir string) error {
+	if subDir == "" || strings.Contains(subDir, "/") || strings.Contains(subDir, "..") {
+		return fmt.Errorf("invalid volume sub-directory %q: must be a single path element without \"..\"", subDir)
+	}
+	return nil
+}
+
+// parseStorageClassOptions reads the server/path/vers/mode/options/archiveOnDelete
+// parameters a NAS StorageClass supports. Keys are matched case-insensitively,
+// and the NAS host is "server" here where NodeStageVolume's VolumeContext uses "host".
+func parseStorageClassOptions(params map[string]string) (*NasOptions, bool, error) {
+	opt := &NasOptions{}
+	archiveOnDelete := false
+	for key, value := range params {
+		switch strings.ToLower(key) {
+		case "server":
+			opt.Server = value
+		case "path":
+			opt.Path = value
+		case "vers":
+			opt.Vers = value
+		case "mode":
+			opt.Mode = value
+		case "options":
+			opt.Options = value
+		case "archiveondelete":
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, false, fmt.Errorf("archiveOnDelete must be true/false, got: %s", value)
+			}
+			archiveOnDelete = v
+		}
+	}
+	if err := validateNasOptions(opt); err != nil {
+		return nil, false, err
+	}
+	return opt, archiveOnDelete, nil
+}
+
+// mountParentExport mounts opt's parent export into a scratch directory under
+// NAS_TEMP_MNTPath so CreateVolume/DeleteVolume can mkdir/rmdir inside it.
+// Callers must unmount the returned path when done.
+func (cs *controllerServer) mountParentExport(opt *NasOptions) (string, error) {
+	tmpPath := filepath.Join(NAS_TEMP_MNTPath, "controller", strconv.Itoa(int(time.Now().UnixNano())))
+	if err := utils.CreateDest(tmpPath); err != nil {
+		return "", err
+	}
+	if err := cs.mounter.Mount(opt.Server+":"+opt.Path, tmpPath, "nfs", nfsMountOptions(opt)); err != nil {
+		return "", fmt.Errorf("Nas, mount parent export %s:%s fail: %v", opt.Server, opt.Path, err)
+	}
+	return tmpPath, nil
+}
+
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolume: name is empty")
+	}
+
+	opt, archiveOnDelete, err := parseStorageClassOptions(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	subDir := req.GetName()
+	if err := validateSubDir(subDir); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	tmpPath, err := cs.mountParentExport(opt)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer cs.mounter.Unmount(tmpPath)
+
+	subPath := filepath.Join(tmpPath, subDir)
+	if err := utils.CreateDest(subPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "Nas, create sub directory %s fail: %v", subDir, err)
+	}
+
+	volumeContext := map[string]string{
+		"host": opt.Server,
+		"path": filepath.Join(opt.Path, subDir),
+		"vers": opt.Vers,
+	}
+	if opt.Mode != "" {
+		volumeContext["mode"] = opt.Mode
+	}
+	if opt.Options != "" {
+		volumeContext["options"] = opt.Options
+	}
+
+	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
+
+	volumeId, err := packVolumeId(opt, subDir, archiveOnDelete)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Nas, encode volumeId fail: %v", err)
+	}
+	log.Infof("Nas, CreateVolume success, volume: %s, sub directory: %s", req.GetName(), subDir)
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeId,
+			CapacityBytes: capacityBytes,
+			VolumeContext: volumeContext,
+		},
+	}, nil
+}
+
+func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteVolume: volumeId is empty")
+	}
+
+	opt, subDir, archiveOnDelete, err := unpackVolumeId(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateSubDir(subDir); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	tmpPath, err := cs.mountParentExport(opt)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer cs.mounter.Unmount(tmpPath)
+
+	subPath := filepath.Join(tmpPath, subDir)
+	if _, err := os.Stat(subPath); os.IsNotExist(err) {
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	if archiveOnDelete {
+		archivePath := filepath.Join(tmpPath, "archived-"+subDir+"-"+strconv.FormatInt(time.Now().Unix(), 10))
+		if err := os.Rename(subPath, archivePath); err != nil {
+			return nil, status.Errorf(codes.Internal, "Nas, archive sub directory %s fail: %v", subDir, err)
+		}
+		log.Infof("Nas, DeleteVolume archived sub directory %s to %s", subDir, archivePath)
+	} else {
+		if err := os.RemoveAll(subPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "Nas, remove sub directory %s fail: %v", subDir, err)
+		}
+		log.Infof("Nas, DeleteVolume removed sub directory %s", subDir)
+	}
+
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerExpandVolume is a no-op for NFS: capacity comes from the filer,
+// not from anything the controller can resize.
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, errors.New("volumeId is empty")
+	}
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         req.GetCapacityRange().GetRequiredBytes(),
+		NodeExpansionRequired: false,
+	}, nil
+}
+
+func (cs *controllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	rpcTypes := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	}
+
+	capabilities := make([]*csi.ControllerServiceCapability, 0, len(rpcTypes))
+	for _, rpcType := range rpcTypes {
+		capabilities = append(capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: rpcType,
+				},
+			},
+		})
+	}
+
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: capabilities}, nil
+}
@@ -0,0 +1,369 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nas
+
+// A hand-rolled implementation of the Docker Volume Plugin HTTP protocol
+// (https://docs.docker.com/engine/extend/plugins_volume/), so the NAS mount
+// logic in this package can also drive plain Docker / docker-compose / Swarm
+// hosts that aren't running Kubernetes.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/AliyunContainerService/csi-plugin/pkg/utils"
+	log "github.com/Sirupsen/logrus"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	dockerPluginSockDir   = "/run/docker/plugins"
+	dockerPluginMediaType = "application/vnd.docker.plugins.v1.1+json"
+	dockerVolumeStateFile = "nas-docker-volumes.json"
+)
+
+// dockerVolume is the persisted state for a single Docker volume backed by a
+// NAS export. It's kept small and JSON-encodable so it round-trips through
+// the state file across daemon restarts.
+type dockerVolume struct {
+	Name       string      `json:"name"`
+	Mountpoint string      `json:"mountpoint"`
+	Opt        *NasOptions `json:"opt"`
+	mounts     int         // in-memory only: number of active Mount calls, for idempotent Unmount
+}
+
+// VolumePlugin serves the Docker Volume Plugin protocol for NAS volumes,
+// reusing the same mount/sub-dir-create code paths as the CSI node server.
+type VolumePlugin struct {
+	mounter   mount.Interface
+	locks     *VolumeLocks
+	stateFile string
+
+	mu      sync.Mutex
+	volumes map[string]*dockerVolume
+}
+
+// NewVolumePlugin creates a VolumePlugin whose state file lives under stateDir.
+// Existing state, if any, is loaded immediately so Mount/Unmount are idempotent
+// across daemon restarts.
+func NewVolumePlugin(stateDir string) (*VolumePlugin, error) {
+	p := &VolumePlugin{
+		mounter:   mount.New(""),
+		locks:     NewVolumeLocks(),
+		stateFile: filepath.Join(stateDir, dockerVolumeStateFile),
+		volumes:   make(map[string]*dockerVolume),
+	}
+	if err := p.loadState(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *VolumePlugin) loadState() error {
+	data, err := ioutil.ReadFile(p.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var volumes map[string]*dockerVolume
+	if err := json.Unmarshal(data, &volumes); err != nil {
+		return err
+	}
+	p.volumes = volumes
+	return nil
+}
+
+// saveState persists the known volumes. Caller must hold p.mu.
+func (p *VolumePlugin) saveState() error {
+	data, err := json.Marshal(p.volumes)
+	if err != nil {
+		return err
+	}
+	if err := utils.CreateDest(filepath.Dir(p.stateFile)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.stateFile, data, 0600)
+}
+
+// ListenAndServe serves the plugin protocol on a Unix socket named after the
+// driver, under /run/docker/plugins, and blocks until the listener errors out.
+func (p *VolumePlugin) ListenAndServe(driverName string) error {
+	sockPath := filepath.Join(dockerPluginSockDir, driverName+".sock")
+	if err := utils.CreateDest(dockerPluginSockDir); err != nil {
+		return err
+	}
+	os.Remove(sockPath)
+
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return err
+	}
+	log.Infof("Nas docker volume plugin listening on %s", sockPath)
+	return http.Serve(l, p.handler())
+}
+
+func (p *VolumePlugin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", p.handleActivate)
+	mux.HandleFunc("/VolumeDriver.Create", p.handleCreate)
+	mux.HandleFunc("/VolumeDriver.Get", p.handleGet)
+	mux.HandleFunc("/VolumeDriver.List", p.handleList)
+	mux.HandleFunc("/VolumeDriver.Remove", p.handleRemove)
+	mux.HandleFunc("/VolumeDriver.Mount", p.handleMount)
+	mux.HandleFunc("/VolumeDriver.Unmount", p.handleUnmount)
+	mux.HandleFunc("/VolumeDriver.Path", p.handlePath)
+	mux.HandleFunc("/VolumeDriver.Capabilities", p.handleCapabilities)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", dockerPluginMediaType)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Nas docker volume plugin: encode response fail: %s", err.Error())
+	}
+}
+
+func (p *VolumePlugin) handleActivate(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"Implements": []string{"VolumeDriver"},
+	})
+}
+
+type createRequest struct {
+	Name string            `json:"Name"`
+	Opts map[string]string `json:"Opts"`
+}
+
+func (p *VolumePlugin) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var req createRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"Err": err.Error()})
+		return
+	}
+	if err := validateSubDir(req.Name); err != nil {
+		writeJSON(w, map[string]string{"Err": err.Error()})
+		return
+	}
+
+	opt := parseNasOptions(req.Opts)
+	if err := validateNasOptions(opt); err != nil {
+		writeJSON(w, map[string]string{"Err": err.Error()})
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Create is expected to be idempotent: docker-compose re-runs Create for
+	// volumes that already exist and are in active use. Clobbering the entry
+	// would reset Mountpoint/mounts to zero while the real NFS mount is still
+	// live, desyncing Unmount/Path/Get from reality.
+	if existing, ok := p.volumes[req.Name]; ok {
+		if !sameNasOptions(existing.Opt, opt) {
+			writeJSON(w, map[string]string{"Err": "volume already exists with different options: " + req.Name})
+			return
+		}
+		writeJSON(w, map[string]string{})
+		return
+	}
+
+	p.volumes[req.Name] = &dockerVolume{Name: req.Name, Opt: opt}
+	if err := p.saveState(); err != nil {
+		writeJSON(w, map[string]string{"Err": err.Error()})
+		return
+	}
+	writeJSON(w, map[string]string{})
+}
+
+// sameNasOptions reports whether a and b describe the same NAS export.
+func sameNasOptions(a, b *NasOptions) bool {
+	return a.Server == b.Server && a.Path == b.Path && a.Vers == b.Vers &&
+		a.Mode == b.Mode && a.Options == b.Options && a.NetNsPath == b.NetNsPath
+}
+
+type volumeRequest struct {
+	Name string `json:"Name"`
+}
+
+func (p *VolumePlugin) handleGet(w http.ResponseWriter, r *http.Request) {
+	var req volumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"Err": err.Error()})
+		return
+	}
+
+	p.mu.Lock()
+	vol, ok := p.volumes[req.Name]
+	p.mu.Unlock()
+	if !ok {
+		writeJSON(w, map[string]string{"Err": "no such volume: " + req.Name})
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"Volume": map[string]string{"Name": vol.Name, "Mountpoint": vol.Mountpoint},
+	})
+}
+
+func (p *VolumePlugin) handleList(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	volumes := make([]map[string]string, 0, len(p.volumes))
+	for _, vol := range p.volumes {
+		volumes = append(volumes, map[string]string{"Name": vol.Name, "Mountpoint": vol.Mountpoint})
+	}
+	p.mu.Unlock()
+	writeJSON(w, map[string]interface{}{"Volumes": volumes})
+}
+
+func (p *VolumePlugin) handleRemove(w http.ResponseWriter, r *http.Request) {
+	var req volumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"Err": err.Error()})
+		return
+	}
+
+	p.mu.Lock()
+	delete(p.volumes, req.Name)
+	err := p.saveState()
+	p.mu.Unlock()
+	if err != nil {
+		writeJSON(w, map[string]string{"Err": err.Error()})
+		return
+	}
+	writeJSON(w, map[string]string{})
+}
+
+// mountpointFor returns the host path a Docker volume should be mounted at.
+// name ultimately comes from the untrusted request body, so it's validated
+// the same way controllerserver.go validates a sub-directory name before
+// it's ever joined into a host path.
+func (p *VolumePlugin) mountpointFor(name string) (string, error) {
+	if err := validateSubDir(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(NAS_TEMP_MNTPath, "docker", name), nil
+}
+
+func (p *VolumePlugin) handleMount(w http.ResponseWriter, r *http.Request) {
+	var req volumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"Err": err.Error()})
+		return
+	}
+
+	unlock := p.locks.Acquire(req.Name)
+	defer unlock()
+
+	p.mu.Lock()
+	vol, ok := p.volumes[req.Name]
+	p.mu.Unlock()
+	if !ok {
+		writeJSON(w, map[string]string{"Err": "no such volume: " + req.Name})
+		return
+	}
+
+	mountpoint, err := p.mountpointFor(req.Name)
+	if err != nil {
+		writeJSON(w, map[string]string{"Err": err.Error()})
+		return
+	}
+	if !utils.IsMounted(mountpoint) {
+		if err := utils.CreateDest(mountpoint); err != nil {
+			writeJSON(w, map[string]string{"Err": err.Error()})
+			return
+		}
+		mountNfsExport(p.mounter, vol.Opt, req.Name, mountpoint)
+		if !utils.IsMounted(mountpoint) {
+			writeJSON(w, map[string]string{"Err": "mount fail for volume: " + req.Name})
+			return
+		}
+	}
+
+	p.mu.Lock()
+	vol.Mountpoint = mountpoint
+	vol.mounts++
+	err = p.saveState()
+	p.mu.Unlock()
+	if err != nil {
+		writeJSON(w, map[string]string{"Err": err.Error()})
+		return
+	}
+	writeJSON(w, map[string]string{"Mountpoint": mountpoint})
+}
+
+func (p *VolumePlugin) handleUnmount(w http.ResponseWriter, r *http.Request) {
+	var req volumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"Err": err.Error()})
+		return
+	}
+
+	unlock := p.locks.Acquire(req.Name)
+	defer unlock()
+
+	p.mu.Lock()
+	vol, ok := p.volumes[req.Name]
+	p.mu.Unlock()
+	if !ok {
+		writeJSON(w, map[string]string{"Err": "no such volume: " + req.Name})
+		return
+	}
+
+	p.mu.Lock()
+	if vol.mounts > 0 {
+		vol.mounts--
+	}
+	remaining := vol.mounts
+	p.mu.Unlock()
+
+	if remaining == 0 && utils.IsMounted(vol.Mountpoint) {
+		if err := p.mounter.Unmount(vol.Mountpoint); err != nil {
+			writeJSON(w, map[string]string{"Err": err.Error()})
+			return
+		}
+	}
+	writeJSON(w, map[string]string{})
+}
+
+func (p *VolumePlugin) handlePath(w http.ResponseWriter, r *http.Request) {
+	var req volumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"Err": err.Error()})
+		return
+	}
+
+	p.mu.Lock()
+	vol, ok := p.volumes[req.Name]
+	p.mu.Unlock()
+	if !ok {
+		writeJSON(w, map[string]string{"Err": "no such volume: " + req.Name})
+		return
+	}
+	writeJSON(w, map[string]string{"Mountpoint": vol.Mountpoint})
+}
+
+func (p *VolumePlugin) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"Capabilities": map[string]string{"Scope": "local"},
+	})
+}
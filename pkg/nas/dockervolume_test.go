@@ -0,0 +1,194 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nas
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestVolumePlugin(t *testing.T) *VolumePlugin {
+	t.Helper()
+	p, err := NewVolumePlugin(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewVolumePlugin() error = %v", err)
+	}
+	return p
+}
+
+// startFakeNasServer satisfies validateNasOptions' reachability check (it
+// dials host:2049) without needing a real NAS export.
+func startFakeNasServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:"+NAS_PORTNUM)
+	if err != nil {
+		t.Skipf("could not bind fake nas server on port %s: %v", NAS_PORTNUM, err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return "127.0.0.1"
+}
+
+func postJSON(t *testing.T, p *VolumePlugin, path string, body interface{}) map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("marshal request: %v", err)
+	}
+	req := httptest.NewRequest("POST", path, bytes.NewReader(data))
+	rr := httptest.NewRecorder()
+	p.handler().ServeHTTP(rr, req)
+
+	var resp map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal response: %v (body: %s)", err, rr.Body.String())
+	}
+	return resp
+}
+
+// respErr returns the "Err" field of a plugin response, or "" if absent.
+func respErr(resp map[string]interface{}) string {
+	if errVal, ok := resp["Err"]; ok {
+		if s, ok := errVal.(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+func TestHandleCreateRejectsPathTraversal(t *testing.T) {
+	p := newTestVolumePlugin(t)
+	host := startFakeNasServer(t)
+
+	resp := postJSON(t, p, "/VolumeDriver.Create", createRequest{
+		Name: "../../../../etc/cron.d/evil",
+		Opts: map[string]string{"host": host, "path": "/"},
+	})
+
+	if respErr(resp) == "" {
+		t.Fatalf("expected Create to reject a path-traversal volume name, got: %v", resp)
+	}
+	if _, ok := p.volumes["../../../../etc/cron.d/evil"]; ok {
+		t.Fatal("Create registered a volume with a path-traversal name")
+	}
+}
+
+func TestHandleCreateIsIdempotent(t *testing.T) {
+	p := newTestVolumePlugin(t)
+	host := startFakeNasServer(t)
+	opts := map[string]string{"host": host, "path": "/share"}
+
+	if resp := postJSON(t, p, "/VolumeDriver.Create", createRequest{Name: "vol1", Opts: opts}); respErr(resp) != "" {
+		t.Fatalf("first Create failed: %v", resp)
+	}
+
+	// Simulate the volume being mounted and in use before the second Create.
+	p.mu.Lock()
+	p.volumes["vol1"].Mountpoint = "/mnt/acs_mnt/k8s_nas/temp/docker/vol1"
+	p.volumes["vol1"].mounts = 1
+	p.mu.Unlock()
+
+	if resp := postJSON(t, p, "/VolumeDriver.Create", createRequest{Name: "vol1", Opts: opts}); respErr(resp) != "" {
+		t.Fatalf("repeat Create with identical options failed: %v", resp)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.volumes["vol1"].Mountpoint == "" || p.volumes["vol1"].mounts != 1 {
+		t.Fatal("repeat Create clobbered the existing volume's Mountpoint/mounts state")
+	}
+}
+
+func TestHandleCreateRejectsConflictingOptions(t *testing.T) {
+	p := newTestVolumePlugin(t)
+	host := startFakeNasServer(t)
+
+	postJSON(t, p, "/VolumeDriver.Create", createRequest{
+		Name: "vol1",
+		Opts: map[string]string{"host": host, "path": "/share"},
+	})
+
+	resp := postJSON(t, p, "/VolumeDriver.Create", createRequest{
+		Name: "vol1",
+		Opts: map[string]string{"host": host, "path": "/other"},
+	})
+	if respErr(resp) == "" {
+		t.Fatal("expected Create to reject re-creating a volume with different options")
+	}
+}
+
+func TestVolumePluginReloadsStateAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	host := startFakeNasServer(t)
+
+	p1, err := NewVolumePlugin(dir)
+	if err != nil {
+		t.Fatalf("NewVolumePlugin() error = %v", err)
+	}
+	postJSON(t, p1, "/VolumeDriver.Create", createRequest{
+		Name: "vol1",
+		Opts: map[string]string{"host": host, "path": "/share"},
+	})
+
+	p2, err := NewVolumePlugin(dir)
+	if err != nil {
+		t.Fatalf("NewVolumePlugin() (restart) error = %v", err)
+	}
+	if _, ok := p2.volumes["vol1"]; !ok {
+		t.Fatal("restarted VolumePlugin did not reload the previously created volume")
+	}
+}
+
+func TestMountpointForRejectsPathTraversal(t *testing.T) {
+	p := newTestVolumePlugin(t)
+
+	if _, err := p.mountpointFor("../../../../etc/cron.d/evil"); err == nil {
+		t.Fatal("mountpointFor accepted a path-traversal volume name")
+	}
+	if mp, err := p.mountpointFor("vol1"); err != nil || mp == "" {
+		t.Fatalf("mountpointFor rejected a valid volume name: mp=%q err=%v", mp, err)
+	}
+}
+
+func TestHandleMountUnknownVolume(t *testing.T) {
+	p := newTestVolumePlugin(t)
+
+	resp := postJSON(t, p, "/VolumeDriver.Mount", volumeRequest{Name: "does-not-exist"})
+	if respErr(resp) == "" {
+		t.Fatal("expected Mount of an unknown volume to report an error")
+	}
+}
+
+func TestHandleUnmountUnknownVolume(t *testing.T) {
+	p := newTestVolumePlugin(t)
+
+	resp := postJSON(t, p, "/VolumeDriver.Unmount", volumeRequest{Name: "does-not-exist"})
+	if respErr(resp) == "" {
+		t.Fatal("expected Unmount of an unknown volume to report an error")
+	}
+}
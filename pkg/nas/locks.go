@@ -0,0 +1,70 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nas
+
+import "sync"
+
+// volumeLock is a per-volumeId mutex plus a count of callers currently
+// holding or waiting on it, so VolumeLocks knows when it's safe to drop the
+// map entry.
+type volumeLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// VolumeLocks hands out a per-volumeId *sync.Mutex so that Node RPCs for the
+// same volume are serialized while RPCs for different volumes can proceed
+// concurrently. Without this, two concurrent Node RPCs for the same volume
+// race on IsMounted/CreateDest/mount and, in NodeStageVolume, on the
+// createNasSubDir temp mount. Entries are reference-counted and removed once the last holder
+// releases, so the map doesn't grow unbounded across PV/PVC churn.
+type VolumeLocks struct {
+	mux   sync.Mutex
+	inUse map[string]*volumeLock
+}
+
+// NewVolumeLocks returns an empty VolumeLocks ready to use.
+func NewVolumeLocks() *VolumeLocks {
+	return &VolumeLocks{inUse: make(map[string]*volumeLock)}
+}
+
+// Acquire blocks until the lock for id is held, then returns a function that
+// releases it. Callers should hold the lock for the full duration of the
+// operation, including any goroutines spawned from it (e.g. the async chmod
+// in NodeStageVolume), to avoid racing with an Unstage/Unpublish of the same id.
+func (l *VolumeLocks) Acquire(id string) func() {
+	l.mux.Lock()
+	v, ok := l.inUse[id]
+	if !ok {
+		v = &volumeLock{}
+		l.inUse[id] = v
+	}
+	v.refs++
+	l.mux.Unlock()
+
+	v.mu.Lock()
+	return func() {
+		v.mu.Unlock()
+
+		l.mux.Lock()
+		v.refs--
+		if v.refs == 0 {
+			delete(l.inUse, id)
+		}
+		l.mux.Unlock()
+	}
+}
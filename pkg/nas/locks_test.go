@@ -0,0 +1,106 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nas
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVolumeLocksSerializesSameId(t *testing.T) {
+	l := NewVolumeLocks()
+
+	unlock := l.Acquire("vol-1")
+
+	acquired := make(chan struct{})
+	go func() {
+		unlock2 := l.Acquire("vol-1")
+		close(acquired)
+		unlock2()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("second Acquire for the same id returned before the first was released")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("second Acquire never returned after the first was released")
+	}
+}
+
+func TestVolumeLocksDifferentIdsDontBlock(t *testing.T) {
+	l := NewVolumeLocks()
+
+	unlock := l.Acquire("vol-1")
+	defer unlock()
+
+	done := make(chan struct{})
+	go func() {
+		unlock2 := l.Acquire("vol-2")
+		unlock2()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Acquire for a different id blocked on an unrelated lock")
+	}
+}
+
+func TestVolumeLocksReleasesMapEntry(t *testing.T) {
+	l := NewVolumeLocks()
+
+	unlock := l.Acquire("vol-1")
+	unlock()
+
+	l.mux.Lock()
+	_, ok := l.inUse["vol-1"]
+	l.mux.Unlock()
+	if ok {
+		t.Fatal("VolumeLocks kept a map entry after the only holder released it")
+	}
+}
+
+func TestVolumeLocksConcurrentAcquireRelease(t *testing.T) {
+	l := NewVolumeLocks()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := l.Acquire("vol-1")
+			defer unlock()
+		}()
+	}
+	wg.Wait()
+
+	l.mux.Lock()
+	_, ok := l.inUse["vol-1"]
+	l.mux.Unlock()
+	if ok {
+		t.Fatal("VolumeLocks leaked a map entry after all concurrent holders released it")
+	}
+}
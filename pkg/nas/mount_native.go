@@ -0,0 +1,102 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nas
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AliyunContainerService/csi-plugin/pkg/utils"
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	mount "k8s.io/mount-utils"
+)
+
+// enableNsenterMount mirrors the design ceph-csi uses for NFS: when a pod's
+// netns can't reach the NAS server the same way the node's default netns can
+// (non-host networking, restricted egress, per-namespace routing), re-exec the
+// mount inside that pod's network namespace via nsenter instead.
+var enableNsenterMount = flag.Bool("enable-nsenter-mount", false, "re-exec NFS mounts inside a pod's network namespace via nsenter when the node's own netns can't reach the NAS server")
+
+const (
+	mountViaNative  = "native"
+	mountViaNsenter = "nsenter"
+	mountViaShell   = "shell"
+)
+
+// mountNfsWithFallback tries, in order: a native mount(2) syscall from the
+// node's netns, an nsenter-into-pod-netns mount (only if --enable-nsenter-mount
+// is set and opt.NetNsPath is known), and finally the mount-utils (shell-based)
+// mounter. It returns which one succeeded.
+func mountNfsWithFallback(mounter mount.Interface, opt *NasOptions, target string) (string, error) {
+	if err := mountNfsNative(opt, target); err != nil {
+		log.Infof("Nas, native mount(2) fail, falling back: %s", err.Error())
+	} else {
+		return mountViaNative, nil
+	}
+
+	if *enableNsenterMount && opt.NetNsPath != "" {
+		if err := mountNfsNsenter(opt, target); err != nil {
+			log.Infof("Nas, nsenter mount fail, falling back to shell mount: %s", err.Error())
+		} else {
+			return mountViaNsenter, nil
+		}
+	}
+
+	if err := mounter.Mount(opt.Server+":"+opt.Path, target, "nfs", nfsMountOptions(opt)); err != nil {
+		return "", err
+	}
+	return mountViaShell, nil
+}
+
+// mountNfsNative mounts opt.Server:opt.Path onto target with a direct mount(2)
+// syscall. The kernel nfs filesystem type wants addr=<ip> rather than a
+// hostname, so opt.Server is resolved first.
+func mountNfsNative(opt *NasOptions, target string) error {
+	ips, err := net.LookupHost(opt.Server)
+	if err != nil || len(ips) == 0 {
+		return fmt.Errorf("could not resolve nas host %s: %v", opt.Server, err)
+	}
+
+	data := fmt.Sprintf("nfsvers=%s,addr=%s", opt.Vers, ips[0])
+	if opt.Options != "" {
+		data = opt.Options + "," + data
+	}
+
+	if err := unix.Mount(opt.Server+":"+opt.Path, target, "nfs", 0, data); err != nil {
+		return fmt.Errorf("mount(2) fail: %v", err)
+	}
+	return nil
+}
+
+// mountNfsNsenter re-execs the mount inside opt.NetNsPath's network namespace,
+// e.g. `nsenter --net=/proc/<pid>/ns/net mount -t nfs -o ... server:path target`.
+func mountNfsNsenter(opt *NasOptions, target string) error {
+	if opt.NetNsPath == "" {
+		return fmt.Errorf("nsenter mount requires a pod network namespace path")
+	}
+
+	options := strings.Join(nfsMountOptions(opt), ",")
+	mntCmd := fmt.Sprintf("nsenter --net=%s mount -t nfs -o %s %s:%s %s",
+		opt.NetNsPath, options, opt.Server, opt.Path, target)
+	if _, err := utils.Run(mntCmd); err != nil {
+		return err
+	}
+	return nil
+}
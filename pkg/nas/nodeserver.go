@@ -24,19 +24,19 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/AliyunContainerService/csi-plugin/pkg/utils"
 	log "github.com/Sirupsen/logrus"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
 )
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	mounter mount.Interface
+	locks   *VolumeLocks
 }
 
 type NasOptions struct {
@@ -45,6 +45,11 @@ type NasOptions struct {
 	Vers    string `json:"vers"`
 	Mode    string `json:"mode"`
 	Options string `json:"options"`
+	// NetNsPath, when set, is the target pod's network namespace
+	// (e.g. /proc/<pid>/ns/net). It's only consulted when --enable-nsenter-mount
+	// is set and the native mount(2) from the node's own netns fails; the shell
+	// mount is tried after it.
+	NetNsPath string `json:"netNsPath"`
 }
 
 const (
@@ -52,39 +57,50 @@ const (
 	NAS_PORTNUM      = "2049"
 )
 
-func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-
-	log.Infof("Nas Plugin Mount: %s", req.VolumeContext)
+// NewNodeServer creates a nodeServer, detecting the host mounter implementation
+// once here so every Node RPC reuses it instead of re-probing on every call.
+func NewNodeServer(d *csicommon.DefaultNodeServer) csi.NodeServer {
+	return &nodeServer{
+		DefaultNodeServer: d,
+		mounter:           mount.New(""),
+		locks:             NewVolumeLocks(),
+	}
+}
 
-	// parse parameters
-	mountPath := req.GetTargetPath()
+// parseNasOptions extracts the NasOptions the driver accepts from a
+// NodePublishVolume/NodeStageVolume VolumeContext.
+func parseNasOptions(volCtx map[string]string) *NasOptions {
 	opt := &NasOptions{}
-	for key, value := range req.VolumeContext {
-		if key == "host" {
+	for key, value := range volCtx {
+		switch key {
+		case "host":
 			opt.Server = value
-		} else if key == "path" {
+		case "path":
 			opt.Path = value
-		} else if key == "vers" {
+		case "vers":
 			opt.Vers = value
-		} else if key == "mode" {
+		case "mode":
 			opt.Mode = value
-		} else if key == "options" {
+		case "options":
 			opt.Options = value
+		case "netNsPath":
+			opt.NetNsPath = value
 		}
 	}
+	return opt
+}
 
-	// check parameters
-	if mountPath == "" {
-		return nil, errors.New("mountPath is empty")
-	}
+// validateNasOptions fills in defaults and rejects options that can't produce
+// a valid mount command, including a reachability check of the NAS host.
+func validateNasOptions(opt *NasOptions) error {
 	if opt.Server == "" {
-		return nil, errors.New("host is empty, should input nas domain")
+		return errors.New("host is empty, should input nas domain")
 	}
 	// check network connection
 	conn, err := net.DialTimeout("tcp", opt.Server+":"+NAS_PORTNUM, time.Second*time.Duration(3))
 	if err != nil {
 		log.Errorf("NAS: Cannot connect to nas host: %s", opt.Server)
-		return nil, errors.New("NAS: Cannot connect to nas host: " + opt.Server)
+		return errors.New("NAS: Cannot connect to nas host: " + opt.Server)
 	}
 	defer conn.Close()
 
@@ -92,7 +108,7 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		opt.Path = "/"
 	}
 	if !strings.HasPrefix(opt.Path, "/") {
-		return nil, errors.New("the path format is illegal")
+		return errors.New("the path format is illegal")
 	}
 	if opt.Vers == "" {
 		opt.Vers = "3"
@@ -111,57 +127,125 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	} else if strings.ToLower(opt.Options) == "none" {
 		opt.Options = ""
 	}
+	return nil
+}
 
-	if utils.IsMounted(mountPath) {
-		log.Infof("Nas, Mount Path Already Mount, options: %s", mountPath)
-		return &csi.NodePublishVolumeResponse{}, nil
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, errors.New("stagingTargetPath is empty")
+	}
+	if req.GetVolumeId() == "" {
+		return nil, errors.New("volumeId is empty")
 	}
 
-	// Create Mount Path
-	if err := utils.CreateDest(mountPath); err != nil {
-		return nil, errors.New("Nas, Mount error with create Path fail: " + mountPath)
+	unlock := ns.locks.Acquire(req.GetVolumeId())
+	unlockOnReturn := true
+	defer func() {
+		if unlockOnReturn {
+			unlock()
+		}
+	}()
+
+	log.Infof("Nas Plugin Stage: %s", req.VolumeContext)
+
+	opt := parseNasOptions(req.GetVolumeContext())
+	if err := validateNasOptions(opt); err != nil {
+		return nil, err
 	}
 
-	// Do mount
-	mntCmd := fmt.Sprintf("mount -t nfs -o vers=%s %s:%s %s", opt.Vers, opt.Server, opt.Path, mountPath)
-	if opt.Options != "" {
-		mntCmd = fmt.Sprintf("mount -t nfs -o vers=%s,%s %s:%s %s", opt.Vers, opt.Options, opt.Server, opt.Path, mountPath)
+	if utils.IsMounted(stagingPath) {
+		log.Infof("Nas, Stage Path Already Mount, options: %s", stagingPath)
+		return &csi.NodeStageVolumeResponse{}, nil
 	}
-	_, err = utils.Run(mntCmd)
 
-	// Mount to nfs Sub-directory
-	if err != nil && opt.Path != "/" {
-		if strings.Contains(err.Error(), "reason given by server: No such file or directory") || strings.Contains(err.Error(), "access denied by server while mounting") {
-			ns.createNasSubDir(opt, req.VolumeId)
-			if _, err := utils.Run(mntCmd); err != nil {
-				log.Errorf("Nas, Mount Nfs sub directory fail: %s", err.Error())
-			}
-		} else {
-			log.Errorf("Nas, Mount Nfs fail with error: %s", err.Error())
-		}
-		// mount error
-	} else if err != nil {
-		log.Errorf("Nas, Mount nfs fail: %s", err.Error())
+	// Create Mount Path
+	if err := utils.CreateDest(stagingPath); err != nil {
+		return nil, errors.New("Nas, Stage error with create Path fail: " + stagingPath)
 	}
 
-	// change the mode
-	if opt.Mode != "" && opt.Path != "/" {
-		var wg1 sync.WaitGroup
-		wg1.Add(1)
+	// Do mount, creating the NFS sub-directory on demand if it doesn't exist yet
+	mountNfsExport(ns.mounter, opt, req.GetVolumeId(), stagingPath)
+
+	// check mount
+	if !utils.IsMounted(stagingPath) {
+		return nil, errors.New("Check mount fail after stage:" + stagingPath)
+	}
 
-		go func(*sync.WaitGroup) {
-			cmd := fmt.Sprintf("chmod -R %s %s", opt.Mode, mountPath)
+	// Change the mode in the background so a slow chmod -R doesn't hold up the
+	// RPC, but hand the per-volume lock off to the goroutine so it's only
+	// released once chmod finishes — otherwise an Unstage/Unpublish racing in
+	// right after we return could unmount stagingPath while chmod is mid-flight.
+	if opt.Mode != "" && opt.Path != "/" {
+		unlockOnReturn = false
+		go func() {
+			defer unlock()
+			cmd := fmt.Sprintf("chmod -R %s %s", opt.Mode, stagingPath)
 			if _, err := utils.Run(cmd); err != nil {
 				log.Errorf("Nas chmod cmd fail: %s %s", cmd, err)
 			} else {
 				log.Infof("Nas chmod cmd success: %s", cmd)
 			}
-			wg1.Done()
-		}(&wg1)
+		}()
+	}
 
-		if waitTimeout(&wg1, 1) {
-			log.Infof("Chmod use more than 1s, running in Concurrency: %s", mountPath)
-		}
+	log.Info("Stage success on: " + stagingPath)
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+
+	stagingPath := req.GetStagingTargetPath()
+	if req.GetVolumeId() == "" {
+		return nil, errors.New("volumeId is empty")
+	}
+
+	unlock := ns.locks.Acquire(req.GetVolumeId())
+	defer unlock()
+
+	if !utils.IsMounted(stagingPath) {
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	if err := ns.mounter.Unmount(stagingPath); err != nil {
+		return nil, errors.New("Nas, Unstage nfs Fail: " + err.Error())
+	}
+
+	log.Info("Unstage nfs Successful: ", stagingPath)
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+
+	log.Infof("Nas Plugin Mount: %s", req.VolumeContext)
+
+	mountPath := req.GetTargetPath()
+	stagingPath := req.GetStagingTargetPath()
+	if mountPath == "" {
+		return nil, errors.New("mountPath is empty")
+	}
+	if stagingPath == "" {
+		return nil, errors.New("Nas, NodePublishVolume need stagingTargetPath, please run NodeStageVolume first")
+	}
+
+	unlock := ns.locks.Acquire(req.GetVolumeId())
+	defer unlock()
+
+	if utils.IsMounted(mountPath) {
+		log.Infof("Nas, Mount Path Already Mount, options: %s", mountPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	// Create Mount Path
+	if err := utils.CreateDest(mountPath); err != nil {
+		return nil, errors.New("Nas, Mount error with create Path fail: " + mountPath)
+	}
+
+	// Bind mount the staged NAS export into the pod's target path
+	if err := ns.mounter.Mount(stagingPath, mountPath, "", []string{"bind"}); err != nil {
+		return nil, errors.New("Nas, Bind mount fail: " + err.Error())
 	}
 
 	// check mount
@@ -173,22 +257,41 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-func waitTimeout(wg *sync.WaitGroup, timeout int) bool {
-	c := make(chan struct{})
-	go func() {
-		defer close(c)
-		wg.Wait()
-	}()
-	select {
-	case <-c:
-		return false
-	case <-time.After(time.Duration(timeout) * time.Second):
-		return true
+// nfsMountOptions assembles the `-o` option list for mounting opt against NFS.
+func nfsMountOptions(opt *NasOptions) []string {
+	options := []string{"vers=" + opt.Vers}
+	if opt.Options != "" {
+		options = append(options, strings.Split(opt.Options, ",")...)
 	}
+	return options
+}
 
+// mountNfsExport mounts opt.Server:opt.Path onto target. If that mount fails
+// because the export doesn't have the sub-directory yet, it creates the
+// sub-directory and mounts again. It is shared by the
+// CSI NodeStageVolume path and the Docker Volume Plugin Mount handler. It tries
+// the native/nsenter/shell mount chain (see mount_native.go) and logs which one
+// actually mounted the export.
+func mountNfsExport(mounter mount.Interface, opt *NasOptions, volumeId, target string) {
+	usedVia, err := mountNfsWithFallback(mounter, opt, target)
+	if err != nil && opt.Path != "/" {
+		if strings.Contains(err.Error(), "reason given by server: No such file or directory") || strings.Contains(err.Error(), "access denied by server while mounting") {
+			createNasSubDir(mounter, opt, volumeId)
+			if usedVia, err = mountNfsWithFallback(mounter, opt, target); err != nil {
+				log.Errorf("Nas, Mount Nfs sub directory fail: %s", err.Error())
+			}
+		} else {
+			log.Errorf("Nas, Mount Nfs fail with error: %s", err.Error())
+		}
+	} else if err != nil {
+		log.Errorf("Nas, Mount nfs fail: %s", err.Error())
+	}
+	if err == nil {
+		log.Infof("Nas, mounted %s via %s mount path", target, usedVia)
+	}
 }
 
-func (ns *nodeServer) createNasSubDir(opt *NasOptions, volumeId string) {
+func createNasSubDir(mounter mount.Interface, opt *NasOptions, volumeId string) {
 	// step 1: create mount path
 	nasTmpPath := filepath.Join(NAS_TEMP_MNTPath, volumeId)
 	if err := utils.CreateDest(nasTmpPath); err != nil {
@@ -201,15 +304,12 @@ func (ns *nodeServer) createNasSubDir(opt *NasOptions, volumeId string) {
 
 	// step 2: do mount
 	usePath := opt.Path
-	mntCmd := fmt.Sprintf("mount -t nfs -o vers=%s %s:%s %s", opt.Vers, opt.Server, "/", nasTmpPath)
-	_, err := utils.Run(mntCmd)
+	err := mounter.Mount(opt.Server+":/", nasTmpPath, "nfs", []string{"vers=" + opt.Vers})
 	if err != nil {
 		if strings.Contains(err.Error(), "reason given by server: No such file or directory") || strings.Contains(err.Error(), "access denied by server while mounting") {
 			if strings.HasPrefix(opt.Path, "/share/") {
 				usePath = usePath[6:]
-				mntCmd = fmt.Sprintf("mount -t nfs -o vers=%s %s:%s %s", opt.Vers, opt.Server, "/share", nasTmpPath)
-				_, err := utils.Run(mntCmd)
-				if err != nil {
+				if err := mounter.Mount(opt.Server+":/share", nasTmpPath, "nfs", []string{"vers=" + opt.Vers}); err != nil {
 					log.Errorf("Nas, Mount to temp directory(with /share) fail: %s", err.Error())
 				}
 			} else {
@@ -219,26 +319,29 @@ func (ns *nodeServer) createNasSubDir(opt *NasOptions, volumeId string) {
 			log.Errorf("Nas, Mount to temp directory fail: %s", err.Error())
 		}
 	}
-	subPath := path.Join(nasTmpPath, opt.Path)
+	subPath := path.Join(nasTmpPath, usePath)
 	if err := utils.CreateDest(subPath); err != nil {
 		log.Infof("Nas, Create Sub Directory err: " + err.Error())
 		return
 	}
 
 	// step 3: umount after create
-	utils.Umount(nasTmpPath)
+	mounter.Unmount(nasTmpPath)
 	log.Info("Create Sub Directory success: ", opt.Path)
 }
 
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 
 	mountPoint := req.TargetPath
+
+	unlock := ns.locks.Acquire(req.GetVolumeId())
+	defer unlock()
+
 	if !utils.IsMounted(mountPoint) {
 		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
 
-	umntCmd := fmt.Sprintf("umount %s", mountPoint)
-	if _, err := utils.Run(umntCmd); err != nil {
+	if err := ns.mounter.Unmount(mountPoint); err != nil {
 		return nil, errors.New("Nas, Umount nfs Fail: " + err.Error())
 	}
 
@@ -246,16 +349,24 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeStageVolume(
-	ctx context.Context,
-	req *csi.NodeStageVolumeRequest) (
-	*csi.NodeStageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
+func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	rpcTypes := []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+	}
+
+	capabilities := make([]*csi.NodeServiceCapability, 0, len(rpcTypes))
+	for _, rpcType := range rpcTypes {
+		capabilities = append(capabilities, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: rpcType,
+				},
+			},
+		})
+	}
 
-func (ns *nodeServer) NodeUnstageVolume(
-	ctx context.Context,
-	req *csi.NodeUnstageVolumeRequest) (
-	*csi.NodeUnstageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: capabilities}, nil
 }
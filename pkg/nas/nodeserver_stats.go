@@ -0,0 +1,96 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nas
+
+import (
+	"context"
+	"errors"
+
+	"github.com/AliyunContainerService/csi-plugin/pkg/utils"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volumePath is empty")
+	}
+
+	if !utils.IsMounted(volumePath) {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  "volume path is not mounted: " + volumePath,
+			},
+		}, nil
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(volumePath, &statfs); err != nil {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  "statfs on volume path failed: " + err.Error(),
+			},
+		}, nil
+	}
+
+	totalBytes := int64(statfs.Blocks) * int64(statfs.Bsize)
+	availableBytes := int64(statfs.Bavail) * int64(statfs.Bsize)
+	usedBytes := totalBytes - int64(statfs.Bfree)*int64(statfs.Bsize)
+
+	totalInodes := int64(statfs.Files)
+	availableInodes := int64(statfs.Ffree)
+	usedInodes := totalInodes - availableInodes
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     totalBytes,
+				Available: availableBytes,
+				Used:      usedBytes,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     totalInodes,
+				Available: availableInodes,
+				Used:      usedInodes,
+			},
+		},
+		VolumeCondition: &csi.VolumeCondition{
+			Abnormal: false,
+		},
+	}, nil
+}
+
+// NodeExpandVolume is a no-op for NFS: capacity comes from the filer, not from
+// anything the node can resize. We still validate the path is actually
+// mounted so a caller doesn't mistake a missing mount for a successful expand.
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, errors.New("volumePath is empty")
+	}
+	if !utils.IsMounted(volumePath) {
+		return nil, status.Error(codes.NotFound, "volume path is not mounted: "+volumePath)
+	}
+	return &csi.NodeExpandVolumeResponse{}, nil
+}